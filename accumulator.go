@@ -0,0 +1,35 @@
+package main
+
+import "sync"
+
+// brokenAccumulator collects broken uuids from multiple worker goroutines,
+// deduplicating as they arrive.
+type brokenAccumulator struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	list []string
+}
+
+func newBrokenAccumulator() *brokenAccumulator {
+	return &brokenAccumulator{seen: map[string]bool{}}
+}
+
+func (b *brokenAccumulator) add(uuid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.seen[uuid] {
+		return
+	}
+	b.seen[uuid] = true
+	b.list = append(b.list, uuid)
+}
+
+func (b *brokenAccumulator) items() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]string, len(b.list))
+	copy(out, b.list)
+	return out
+}
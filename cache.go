@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheEntry is the sidecar stored alongside a cached document-store
+// response, recording when it was fetched, its ETag (if any) and a hash
+// of the body so a corrupted entry (e.g. a body file edited or truncated
+// out from under the cache) can be told apart from a genuine hit.
+type cacheEntry struct {
+	FetchedAt time.Time `json:"fetchedAt"`
+	ETag      string    `json:"etag,omitempty"`
+	Hash      string    `json:"hash"`
+}
+
+// docCache is a persistent on-disk cache of document-store responses,
+// keyed by uuid, so re-runs against the same uuid set (very common when
+// iterating on a -brokenfile list) skip repeat calls to
+// getContentFromDocumentStore. Freshness is bounded purely by -cache-ttl:
+// the stored hash only guards against a corrupted on-disk entry, not
+// against the uuid being republished with new content before its TTL
+// expires - that would need a round trip to the document store on every
+// hit, which defeats the point of caching. A nil docCache disables
+// caching entirely.
+type docCache struct {
+	dir    string
+	ttl    time.Duration
+	replay bool
+}
+
+// newDocCache builds a docCache rooted at dir, or returns nil if caching
+// is disabled (no -cache-dir, or -no-cache was passed).
+func newDocCache(dir string, ttl time.Duration, replay, disabled bool) (*docCache, error) {
+	if dir == "" || disabled {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &docCache{dir: dir, ttl: ttl, replay: replay}, nil
+}
+
+func (c *docCache) bodyPath(uuid string) string {
+	return filepath.Join(c.dir, uuid+".json")
+}
+
+func (c *docCache) metaPath(uuid string) string {
+	return filepath.Join(c.dir, uuid+".meta.json")
+}
+
+// Get returns uuid's cached response body, if present, unexpired (a ttl
+// <= 0 means cached entries never expire) and intact - a body whose hash
+// no longer matches its sidecar is treated as a miss rather than served.
+func (c *docCache) Get(uuid string) ([]byte, bool) {
+	meta, err := c.readMeta(uuid)
+	if err != nil {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Since(meta.FetchedAt) > c.ttl {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadFile(c.bodyPath(uuid))
+	if err != nil || contentHash(body) != meta.Hash {
+		return nil, false
+	}
+	return body, true
+}
+
+func (c *docCache) readMeta(uuid string) (*cacheEntry, error) {
+	raw, err := ioutil.ReadFile(c.metaPath(uuid))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta cacheEntry
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Put stores body for uuid, writing both the response and its sidecar
+// atomically via a tmpfile-then-rename so a crash mid-write never leaves
+// a corrupt entry behind.
+func (c *docCache) Put(uuid string, body []byte, etag string) error {
+	meta := cacheEntry{
+		FetchedAt: time.Now(),
+		ETag:      etag,
+		Hash:      contentHash(body),
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.bodyPath(uuid), body); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.metaPath(uuid), metaJSON)
+}
+
+// writeFileAtomic writes data to a tmp file alongside path and renames it
+// into place, so readers never observe a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func contentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DuplicateGroup is a cluster of uuids whose image hashes are all within
+// the configured Hamming distance threshold of each other.
+type DuplicateGroup struct {
+	UUIDs    []string `json:"uuids"`
+	Distance int      `json:"maxDistance"`
+}
+
+// imageHash is a 64-bit perceptual difference hash (dHash).
+type imageHash uint64
+
+type duplicateEntry struct {
+	uuid string
+	hash imageHash
+}
+
+// duplicateIndex finds near-duplicate images across a run by bucketing
+// each dHash on its top 16 bits and only doing a full 64-bit Hamming
+// compare against entries already in the same bucket. Two hashes that
+// disagree on every bit of that prefix are never compared, which trades a
+// little recall for not having to compare every uuid pairwise.
+type duplicateIndex struct {
+	threshold int
+
+	mu      sync.Mutex
+	buckets map[uint16][]duplicateEntry
+	hashes  map[string]imageHash
+	links   map[string]map[string]bool
+}
+
+func newDuplicateIndex(threshold int) *duplicateIndex {
+	return &duplicateIndex{
+		threshold: threshold,
+		buckets:   map[uint16][]duplicateEntry{},
+		hashes:    map[string]imageHash{},
+		links:     map[string]map[string]bool{},
+	}
+}
+
+// Add records uuid's hash and links it to any already-indexed uuid within
+// the configured Hamming distance.
+func (idx *duplicateIndex) Add(uuid string, hash imageHash) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	prefix := bucketPrefix(hash)
+	for _, e := range idx.buckets[prefix] {
+		if hammingDistance(hash, e.hash) <= idx.threshold {
+			idx.link(uuid, e.uuid)
+		}
+	}
+
+	idx.buckets[prefix] = append(idx.buckets[prefix], duplicateEntry{uuid: uuid, hash: hash})
+	idx.hashes[uuid] = hash
+}
+
+func (idx *duplicateIndex) link(a, b string) {
+	if idx.links[a] == nil {
+		idx.links[a] = map[string]bool{}
+	}
+	if idx.links[b] == nil {
+		idx.links[b] = map[string]bool{}
+	}
+	idx.links[a][b] = true
+	idx.links[b][a] = true
+}
+
+// Groups returns the connected components of near-duplicate uuids found
+// across the run, each sorted and annotated with the largest pairwise
+// Hamming distance inside the group.
+func (idx *duplicateIndex) Groups() []DuplicateGroup {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	seen := map[string]bool{}
+	var groups []DuplicateGroup
+	for start := range idx.links {
+		if seen[start] {
+			continue
+		}
+
+		members := idx.component(start, seen)
+		sort.Strings(members)
+		groups = append(groups, DuplicateGroup{
+			UUIDs:    members,
+			Distance: idx.maxDistance(members),
+		})
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].UUIDs[0] < groups[j].UUIDs[0] })
+	return groups
+}
+
+// component walks idx.links breadth-first from start, marking every uuid
+// it visits as seen so Groups doesn't emit the same cluster twice.
+func (idx *duplicateIndex) component(start string, seen map[string]bool) []string {
+	queue := []string{start}
+	seen[start] = true
+	var members []string
+
+	for len(queue) > 0 {
+		uuid := queue[0]
+		queue = queue[1:]
+		members = append(members, uuid)
+
+		for neighbour := range idx.links[uuid] {
+			if !seen[neighbour] {
+				seen[neighbour] = true
+				queue = append(queue, neighbour)
+			}
+		}
+	}
+
+	return members
+}
+
+func (idx *duplicateIndex) maxDistance(uuids []string) int {
+	max := 0
+	for i, a := range uuids {
+		for _, b := range uuids[i+1:] {
+			if d := hammingDistance(idx.hashes[a], idx.hashes[b]); d > max {
+				max = d
+			}
+		}
+	}
+	return max
+}
+
+func bucketPrefix(h imageHash) uint16 {
+	return uint16(h >> 48)
+}
+
+func hammingDistance(a, b imageHash) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// computeDHash resizes img to 9x8 grayscale and, for each of its 8 rows,
+// encodes whether brightness increases across each of the 9 adjacent
+// pixel pairs, producing a 64-bit difference hash. Images that look alike
+// to the eye end up with hashes a small Hamming distance apart.
+func computeDHash(img image.Image) imageHash {
+	const w, h = 9, 8
+	gray := resizeGray(img, w, h)
+
+	var hash imageHash
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y*w+x] < gray[y*w+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// resizeGray resizes img to w x h using nearest-neighbor sampling and
+// converts it to grayscale, returning pixels in row-major order. This is
+// deliberately crude: a dHash only cares about relative brightness between
+// neighbouring pixels, not high-fidelity resampling.
+func resizeGray(img image.Image, w, h int) []uint8 {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	out := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		sy := bounds.Min.Y + y*srcH/h
+		for x := 0; x < w; x++ {
+			sx := bounds.Min.X + x*srcW/w
+			out[y*w+x] = color.GrayModel.Convert(img.At(sx, sy)).(color.Gray).Y
+		}
+	}
+	return out
+}
+
+// imageBinaryURLFor builds the URL to fetch uuid's binary image from,
+// substituting uuid into -image-binary-url if it contains a "%s"
+// placeholder, or appending it otherwise (matching -docstoreurl).
+func imageBinaryURLFor(uuid string) string {
+	if strings.Contains(imageBinaryURL, "%s") {
+		return fmt.Sprintf(imageBinaryURL, uuid)
+	}
+	return imageBinaryURL + uuid
+}
+
+func fetchImageBinary(ctx context.Context, uuid string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageBinaryURLFor(uuid), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Basic "+basicAuth)
+	req.Header.Add("X-Request-Id", "tid_ftimageinspector_"+uuid)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("error %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// inspectImageBinary downloads uuid's binary image and records its dHash
+// in the duplicate index, when -image-binary-url is configured. Failures
+// are non-fatal: a missing or undecodable binary just leaves uuid out of
+// duplicate detection, it doesn't mark the content broken.
+func inspectImageBinary(ctx context.Context, uuid string) {
+	if imageBinaryURL == "" {
+		return
+	}
+
+	if err := limiter.Wait(ctx); err != nil {
+		return
+	}
+
+	raw, err := fetchImageBinary(ctx, uuid)
+	if err != nil {
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return
+	}
+
+	dupIndex.Add(uuid, computeDHash(img))
+}
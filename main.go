@@ -1,25 +1,51 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/html"
 )
 
 var (
-	basicAuth   string = ""
-	printOnly   bool   = false
-	docStoreURL string = ""
-	delayInMs   int    = 1000
-	uuidFile    string = ""
-	brokenFile  string = ""
+	basicAuth   string  = ""
+	printOnly   bool    = false
+	docStoreURL string  = ""
+	uuidFile    string  = ""
+	brokenFile  string  = ""
+	workers     int     = 4
+	rps         float64 = 5
+	resume      bool    = false
+	output      string  = "text"
+	maxRetries  int     = 3
+	retryBaseMs int     = 200
+	retryMaxMs  int     = 5000
+	cbThreshold float64 = 0.5
+	cbWindowSec int     = 30
+
+	imageBinaryURL string
+	dupThreshold   int = 5
+
+	cacheDir   string
+	cacheTTL   time.Duration = 0
+	noCache    bool          = false
+	replayMode bool          = false
+
+	maxDepth int = 10
+
+	httpClient *http.Client
+	dupIndex   *duplicateIndex
+	cache      *docCache
+	limiter    *rateLimiter
 )
 
 type Content struct {
@@ -45,15 +71,60 @@ func main() {
 	flag.StringVar(&basicAuth, "auth", "", "base64 encoded auth for the delivery cluster")
 	flag.BoolVar(&printOnly, "printonly", false, "do not check but only print article/image uuids")
 	flag.StringVar(&docStoreURL, "docstoreurl", "", "url of the document store service")
-	flag.IntVar(&delayInMs, "delay", 1000, "throttle delay in miliseconds")
 	flag.StringVar(&uuidFile, "uuidfile", "", "json file that holds a list with the uuids to be verified")
 	flag.StringVar(&brokenFile, "brokenfile", "", "file that will hold the uuid of the broken publications")
+	flag.IntVar(&workers, "workers", workers, "number of uuids to check concurrently")
+	flag.Float64Var(&rps, "rps", rps, "maximum document-store requests per second across all workers (0 = unlimited)")
+	flag.BoolVar(&resume, "resume", false, "only check the uuids listed in an existing -brokenfile from a previous run")
+	flag.StringVar(&output, "output", output, "result output format: text, json or ndjson")
+	flag.IntVar(&maxRetries, "max-retries", maxRetries, "maximum retries for a document-store request on 5xx/429/network errors")
+	flag.IntVar(&retryBaseMs, "retry-base-ms", retryBaseMs, "base backoff delay between retries, in milliseconds")
+	flag.IntVar(&retryMaxMs, "retry-max-ms", retryMaxMs, "maximum backoff delay between retries, in milliseconds")
+	flag.Float64Var(&cbThreshold, "cb-threshold", cbThreshold, "fraction of failed requests within -cb-window that trips the circuit breaker")
+	flag.IntVar(&cbWindowSec, "cb-window", cbWindowSec, "circuit breaker sliding window size, in seconds")
+	flag.StringVar(&imageBinaryURL, "image-binary-url", "", "url (or %s template) to fetch an Image/Graphic's binary from, for duplicate detection; empty disables it")
+	flag.IntVar(&dupThreshold, "dup-threshold", dupThreshold, "maximum Hamming distance between two image hashes for them to count as near-duplicates")
+	flag.StringVar(&cacheDir, "cache-dir", "", "directory to cache document-store responses in, keyed by uuid; empty disables caching")
+	flag.DurationVar(&cacheTTL, "cache-ttl", cacheTTL, "how long a cached response stays fresh (0 = never expires)")
+	flag.BoolVar(&noCache, "no-cache", false, "bypass the cache for this run without disabling -cache-dir for future runs")
+	flag.BoolVar(&replayMode, "replay", false, "serve the whole run from -cache-dir without hitting the document store; errors on a cache miss")
+	flag.IntVar(&maxDepth, "max-depth", maxDepth, "maximum reference depth to recurse into (article -> imageset -> image, etc) before giving up")
 	flag.Parse()
 
 	if len(basicAuth) == 0 {
 		fmt.Print("parameter auth not provided. terminating...\n")
 		os.Exit(-1)
 	}
+	if workers < 1 {
+		fmt.Print("parameter -workers must be at least 1\n")
+		os.Exit(-1)
+	}
+
+	if replayMode && noCache {
+		fmt.Print("parameters -replay and -no-cache cannot be combined\n")
+		os.Exit(-1)
+	}
+	if replayMode && cacheDir == "" {
+		fmt.Print("parameter -replay requires -cache-dir\n")
+		os.Exit(-1)
+	}
+
+	httpClient = newResilientClient(
+		maxRetries,
+		time.Duration(retryBaseMs)*time.Millisecond,
+		time.Duration(retryMaxMs)*time.Millisecond,
+		cbThreshold,
+		time.Duration(cbWindowSec)*time.Second,
+	)
+	dupIndex = newDuplicateIndex(dupThreshold)
+	limiter = newRateLimiter(rps)
+
+	var err error
+	cache, err = newDocCache(cacheDir, cacheTTL, replayMode, noCache)
+	if err != nil {
+		fmt.Printf("unable to init cache at %s: %v\n", cacheDir, err)
+		return
+	}
 
 	fmt.Print("Starting...\n")
 	if printOnly {
@@ -66,35 +137,114 @@ func main() {
 		return
 	}
 
-	broken := []string{}
-	for _, id := range data {
-		err := checkContent(id)
-		if !printOnly {
-			if err != nil {
-				fmt.Printf("broken: %s (%s)\n", id, err)
-				broken = append(broken, id)
-			} else {
-				fmt.Printf("safe: %s\n", id)
-			}
+	if resume {
+		data, err = loadBrokenList(brokenFile)
+		if err != nil {
+			fmt.Printf("unable to resume from broken file %s: %s\n", brokenFile, err)
+			return
 		}
+		fmt.Printf("Resuming: checking %d uuids from %s\n", len(data), brokenFile)
+	}
 
-		time.Sleep(time.Duration(delayInMs) * time.Millisecond)
+	sink, err := newResultSink(output, brokenFile)
+	if err != nil {
+		fmt.Printf("invalid -output: %s\n", err)
+		return
 	}
 
-	if !printOnly && brokenFile != "" {
-		broken = dedupStrings(broken)
-		f, _ := os.Create(brokenFile)
-		defer f.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 
-		_, err := f.WriteString(strings.Join(broken, "\n"))
-		if err != nil {
+	prog := runWorkerPool(ctx, data, sink, newTraversal(maxDepth))
+
+	if !printOnly {
+		if err := sink.Duplicates(dupIndex.Groups()); err != nil {
 			fmt.Printf("error: %v\n", err)
 		}
+		if err := sink.Summary(prog.summary()); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		fmt.Printf("error: %v\n", err)
 	}
 
+	if ctx.Err() != nil {
+		fmt.Print("Interrupted!\n")
+		return
+	}
 	fmt.Print("Finished!\n")
 }
 
+// runWorkerPool fans the given uuids out across `workers` goroutines and
+// reports progress periodically. The document-store request rate is
+// governed by limiter inside getContentFromDocumentStore, not here, so
+// it applies equally to a uuid's own fetch and to every one it
+// recursively references. It returns once every uuid has been checked or
+// ctx is cancelled. t is shared by every worker so the traversal's
+// visited set and depth limit apply across the whole run, not just
+// within one uuid's own references.
+func runWorkerPool(ctx context.Context, data []string, sink ResultSink, t *Traversal) *progress {
+	prog := newProgress(len(data))
+	if !printOnly {
+		go runProgressReporter(ctx, prog, 5*time.Second)
+	}
+
+	jobs := make(chan string)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				start := time.Now()
+				c, err := checkContent(ctx, id, t, nil)
+				if printOnly {
+					continue
+				}
+
+				result := buildResult(id, c, err, time.Since(start))
+				if err := sink.Write(result); err != nil {
+					fmt.Printf("error: %v\n", err)
+				}
+				prog.record(result)
+			}
+		}()
+	}
+
+feed:
+	for _, id := range data {
+		select {
+		case jobs <- id:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return prog
+}
+
+// buildResult turns the outcome of a single checkContent call into the
+// uuid's structured Result.
+func buildResult(uuid string, c *Content, err error, dur time.Duration) Result {
+	r := Result{UUID: uuid, DurationMs: dur.Milliseconds()}
+	if c != nil {
+		r.Type = c.Type
+		r.ReferencedUUIDs = referencedUUIDs(c)
+	}
+
+	if err != nil {
+		r.Status = statusBroken
+		r.Error = err.Error()
+	} else {
+		r.Status = statusOK
+	}
+	return r
+}
+
 func loadUUIDList(fileName string) ([]string, error) {
 	uuidFile, err := os.Open(fileName)
 	if err != nil {
@@ -116,38 +266,97 @@ func loadUUIDList(fileName string) ([]string, error) {
 	return uuids, nil
 }
 
-func checkContent(uuid string) error {
-	c, err := getContentFromDocumentStore(uuid)
+// loadBrokenList reads a newline-delimited list of uuids, as written to
+// -brokenfile, so a previous run's failures can be retried with -resume.
+func loadBrokenList(fileName string) ([]string, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			uuids = append(uuids, line)
+		}
+	}
+	return uuids, nil
+}
+
+// checkContent fetches uuid from the document store and validates it,
+// returning the fetched Content (even on error, where available) so
+// callers can inspect its type and referenced uuids. t and path together
+// guard the recursive traversal across checkArticle/checkImageSet: path is
+// the current DFS stack (for cycle detection) and t is shared across the
+// whole run, so a diamond-shaped reference graph is only fetched and
+// walked once even when two workers reach it at the same time.
+func checkContent(ctx context.Context, uuid string, t *Traversal, path []string) (*Content, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if cycle, isCycle := cyclePath(path, uuid); isCycle {
+		if printOnly {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cycle reference detected: %s", cycle)
+	}
+	if err := checkDepth(path, uuid, t.maxDepth); err != nil {
+		if printOnly {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err, alreadyVisited := t.claim(ctx, uuid); alreadyVisited {
+		return nil, err
+	}
+
+	c, err := getContentFromDocumentStore(ctx, uuid)
 	if err != nil {
 		if printOnly {
 			fmt.Printf("unable to find content with %s in the document-store\n", uuid)
 		}
-		return err
+		t.record(uuid, err)
+		return nil, err
 	}
 
 	if (!printOnly) && (!strings.Contains(c.PublishReference, "tid_methode_carousel_")) {
-		return fmt.Errorf("content %s not published by the upp-methode-converter", uuid)
+		err := fmt.Errorf("content %s not published by the upp-methode-converter", uuid)
+		t.record(uuid, err)
+		return c, err
 	}
 
+	childPath := appendPath(path, uuid)
+
 	switch c.Type {
 	case "Image", "Graphic":
 		if printOnly {
 			fmt.Println(uuid)
 		}
-		return nil //Being able to load the content with the correct tid is OK
+		inspectImageBinary(ctx, uuid)
+		t.record(uuid, nil)
+		return c, nil //Being able to load the content with the correct tid is OK
 	case "ImageSet":
-		return checkImageSet(c)
+		err := checkImageSet(ctx, c, t, childPath)
+		t.record(uuid, err)
+		return c, err
 	case "Article":
 		if printOnly {
 			fmt.Println(uuid)
 		}
-		return checkArticle(c)
+		err := checkArticle(ctx, c, t, childPath)
+		t.record(uuid, err)
+		return c, err
 	default:
-		return fmt.Errorf("error: %s unexpected type %s", uuid, c.Type)
+		err := fmt.Errorf("error: %s unexpected type %s", uuid, c.Type)
+		t.record(uuid, err)
+		return c, err
 	}
 }
 
-func checkArticle(c *Content) error {
+func checkArticle(ctx context.Context, c *Content, t *Traversal, path []string) error {
 	imageSets, err := getImageSetFromBody(c)
 	if err != nil {
 		return err
@@ -155,8 +364,7 @@ func checkArticle(c *Content) error {
 
 	imageSets = dedupStrings(imageSets)
 	for _, imgSet := range imageSets {
-		err = checkContent(imgSet)
-		if err != nil {
+		if _, err := checkContent(ctx, imgSet, t, path); err != nil {
 			return err
 		}
 	}
@@ -164,18 +372,9 @@ func checkArticle(c *Content) error {
 	return nil
 }
 
-func checkImageSet(c *Content) error {
+func checkImageSet(ctx context.Context, c *Content, t *Traversal, path []string) error {
 	for _, member := range c.Members {
-		if c.UUID == member.UUID {
-			if printOnly {
-				continue
-			} else {
-				return fmt.Errorf("cycle reference detected in image set %s", c.UUID)
-			}
-		}
-
-		err := checkContent(member.UUID)
-		if err != nil {
+		if _, err := checkContent(ctx, member.UUID, t, path); err != nil {
 			return err
 		}
 	}
@@ -183,12 +382,31 @@ func checkImageSet(c *Content) error {
 	return nil
 }
 
-func getContentFromDocumentStore(uuid string) (*Content, error) {
+// getContentFromDocumentStore fetches uuid from the document store, or
+// serves it from cache. limiter.Wait is called here rather than only by
+// the top-level worker loop, so every document-store request this run
+// makes - including the ones checkArticle/checkImageSet fire recursively
+// for an Article's ImageSets and their Image members - is governed by
+// -rps, not just the first one per top-level uuid. A cache hit skips the
+// wait entirely since it makes no document-store request at all.
+func getContentFromDocumentStore(ctx context.Context, uuid string) (*Content, error) {
+	if cache != nil {
+		if body, ok := cache.Get(uuid); ok {
+			return parseContent(body)
+		}
+		if cache.replay {
+			return nil, fmt.Errorf("-replay: %s not found in cache", uuid)
+		}
+	}
+
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
 	url := docStoreURL + uuid
 	method := "GET"
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 
 	if err != nil {
 		return nil, err
@@ -196,7 +414,7 @@ func getContentFromDocumentStore(uuid string) (*Content, error) {
 	req.Header.Add("Authorization", "Basic "+basicAuth)
 	req.Header.Add("X-Request-Id", "tid_ftimageinspector_"+uuid)
 
-	res, err := client.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -210,8 +428,18 @@ func getContentFromDocumentStore(uuid string) (*Content, error) {
 		return nil, err
 	}
 
+	if cache != nil {
+		if err := cache.Put(uuid, body, res.Header.Get("ETag")); err != nil {
+			fmt.Printf("warning: unable to cache %s: %v\n", uuid, err)
+		}
+	}
+
+	return parseContent(body)
+}
+
+func parseContent(body []byte) (*Content, error) {
 	var c Content
-	err = json.Unmarshal(body, &c)
+	err := json.Unmarshal(body, &c)
 	return &c, err
 }
 
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks processed/error counts across worker goroutines so a
+// reporter can print processed/total, ETA and error rate while a run is
+// in flight, and so a final Summary can be built once it's done.
+type progress struct {
+	total     int64
+	processed int64
+	errors    int64
+	start     time.Time
+
+	mu           sync.Mutex
+	byType       map[string]int
+	byErrorClass map[string]int
+}
+
+func newProgress(total int) *progress {
+	return &progress{
+		total:        int64(total),
+		start:        time.Now(),
+		byType:       map[string]int{},
+		byErrorClass: map[string]int{},
+	}
+}
+
+func (p *progress) recordSuccess() {
+	atomic.AddInt64(&p.processed, 1)
+}
+
+func (p *progress) recordError() {
+	atomic.AddInt64(&p.processed, 1)
+	atomic.AddInt64(&p.errors, 1)
+}
+
+// record folds a checked Result into the running totals.
+func (p *progress) record(r Result) {
+	if r.Status == statusBroken {
+		p.recordError()
+	} else {
+		p.recordSuccess()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.Type != "" {
+		p.byType[r.Type]++
+	}
+	if r.Status == statusBroken {
+		p.byErrorClass[errorClass(r.Error)]++
+	}
+}
+
+// summary builds the final Summary once a run has finished.
+func (p *progress) summary() Summary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	byType := make(map[string]int, len(p.byType))
+	for k, v := range p.byType {
+		byType[k] = v
+	}
+	byErrorClass := make(map[string]int, len(p.byErrorClass))
+	for k, v := range p.byErrorClass {
+		byErrorClass[k] = v
+	}
+
+	return Summary{
+		Total:        int(atomic.LoadInt64(&p.processed)),
+		Broken:       int(atomic.LoadInt64(&p.errors)),
+		ByType:       byType,
+		ByErrorClass: byErrorClass,
+		WallTime:     time.Since(p.start).Round(time.Millisecond).String(),
+	}
+}
+
+func (p *progress) report() {
+	processed := atomic.LoadInt64(&p.processed)
+	errs := atomic.LoadInt64(&p.errors)
+
+	errRate := 0.0
+	if processed > 0 {
+		errRate = float64(errs) / float64(processed) * 100
+	}
+
+	eta := "unknown"
+	if processed > 0 && processed < p.total {
+		perItem := time.Since(p.start) / time.Duration(processed)
+		eta = (perItem * time.Duration(p.total-processed)).Round(time.Second).String()
+	}
+
+	fmt.Printf("progress: %d/%d processed, %.1f%% errors, eta %s\n", processed, p.total, errRate, eta)
+}
+
+// runProgressReporter prints a progress report every interval until ctx is
+// done.
+func runProgressReporter(ctx context.Context, p *progress, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.report()
+		}
+	}
+}
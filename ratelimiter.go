@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token-bucket limiter shared across all workers:
+// it allows at most one request every 1/rps seconds. A nil rateLimiter
+// (rps <= 0) never blocks, i.e. the rate is unlimited.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// Wait blocks the caller until the next token is available, or returns
+// ctx.Err() if the context is cancelled first.
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	if r == nil {
+		return ctx.Err()
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	wait := time.Duration(0)
+	if r.next.After(now) {
+		wait = r.next.Sub(now)
+		r.next = r.next.Add(r.interval)
+	} else {
+		r.next = now.Add(r.interval)
+	}
+	r.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
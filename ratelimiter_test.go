@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiterUnlimited(t *testing.T) {
+	if r := newRateLimiter(0); r != nil {
+		t.Fatalf("newRateLimiter(0) = %v, want nil", r)
+	}
+	if r := newRateLimiter(-1); r != nil {
+		t.Fatalf("newRateLimiter(-1) = %v, want nil", r)
+	}
+}
+
+func TestRateLimiterWaitNilNeverBlocks(t *testing.T) {
+	var r *rateLimiter
+	if err := r.Wait(context.Background()); err != nil {
+		t.Fatalf("nil rateLimiter.Wait returned %v, want nil", err)
+	}
+}
+
+func TestRateLimiterWaitSpacesCalls(t *testing.T) {
+	const rps = 20.0
+	r := newRateLimiter(rps)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := r.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait returned unexpected error: %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	minExpected := time.Duration(float64(time.Second) / rps * 4)
+	if elapsed < minExpected {
+		t.Fatalf("5 calls at %v rps took %v, want at least %v", rps, elapsed, minExpected)
+	}
+}
+
+func TestRateLimiterWaitRespectsCancellation(t *testing.T) {
+	r := newRateLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := r.Wait(ctx); err != nil {
+		t.Fatalf("first Wait returned unexpected error: %v", err)
+	}
+
+	cancel()
+	if err := r.Wait(ctx); err == nil {
+		t.Fatal("Wait on a cancelled context should return an error")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	statusOK     = "ok"
+	statusBroken = "broken"
+)
+
+// Result is the machine-readable outcome of checking a single uuid.
+type Result struct {
+	UUID            string   `json:"uuid"`
+	Type            string   `json:"type,omitempty"`
+	Status          string   `json:"status"`
+	Error           string   `json:"error,omitempty"`
+	ReferencedUUIDs []string `json:"referencedUuids,omitempty"`
+	DurationMs      int64    `json:"durationMs"`
+}
+
+// Summary is emitted once a run has finished checking every uuid.
+type Summary struct {
+	Total        int            `json:"total"`
+	Broken       int            `json:"broken"`
+	ByType       map[string]int `json:"byType"`
+	ByErrorClass map[string]int `json:"byErrorClass"`
+	WallTime     string         `json:"wallTime"`
+}
+
+// ResultSink receives the outcome of each checked uuid and the final
+// summary, so the reporting format can vary independently of the checking
+// logic.
+type ResultSink interface {
+	Write(r Result) error
+	Duplicates(groups []DuplicateGroup) error
+	Summary(s Summary) error
+	Close() error
+}
+
+// newResultSink builds the ResultSink for the requested -output format.
+func newResultSink(output, brokenFile string) (ResultSink, error) {
+	switch output {
+	case "", "text":
+		return newTextSink(brokenFile), nil
+	case "json":
+		return newJSONSink(os.Stdout, false, brokenFile), nil
+	case "ndjson":
+		return newJSONSink(os.Stdout, true, brokenFile), nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (want text, json or ndjson)", output)
+	}
+}
+
+// textSink reproduces the tool's original human-readable "safe"/"broken"
+// lines and writes the newline-delimited -brokenfile.
+type textSink struct {
+	brokenFile string
+	broken     *brokenAccumulator
+}
+
+func newTextSink(brokenFile string) *textSink {
+	return &textSink{brokenFile: brokenFile, broken: newBrokenAccumulator()}
+}
+
+func (s *textSink) Write(r Result) error {
+	if r.Status == statusBroken {
+		fmt.Printf("broken: %s (%s)\n", r.UUID, r.Error)
+		s.broken.add(r.UUID)
+	} else {
+		fmt.Printf("safe: %s\n", r.UUID)
+	}
+	return nil
+}
+
+func (s *textSink) Duplicates(groups []DuplicateGroup) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	fmt.Printf("found %d duplicate group(s):\n", len(groups))
+	for _, g := range groups {
+		fmt.Printf("  %s (max distance %d)\n", strings.Join(g.UUIDs, ", "), g.Distance)
+	}
+	return nil
+}
+
+func (s *textSink) Summary(sum Summary) error {
+	fmt.Printf("checked %d uuids in %s: %d broken\n", sum.Total, sum.WallTime, sum.Broken)
+	return nil
+}
+
+func (s *textSink) Close() error {
+	if printOnly {
+		return nil
+	}
+	return writeBrokenFile(s.brokenFile, s.broken)
+}
+
+// jsonSink emits one Result per checked uuid followed by a Summary, either
+// streamed as newline-delimited JSON or buffered into a single document.
+type jsonSink struct {
+	enc        *json.Encoder
+	ndjson     bool
+	brokenFile string
+	broken     *brokenAccumulator
+	results    []Result
+	duplicates []DuplicateGroup
+}
+
+func newJSONSink(w io.Writer, ndjson bool, brokenFile string) *jsonSink {
+	return &jsonSink{
+		enc:        json.NewEncoder(w),
+		ndjson:     ndjson,
+		brokenFile: brokenFile,
+		broken:     newBrokenAccumulator(),
+	}
+}
+
+func (s *jsonSink) Write(r Result) error {
+	if r.Status == statusBroken {
+		s.broken.add(r.UUID)
+	}
+
+	if s.ndjson {
+		return s.enc.Encode(r)
+	}
+	s.results = append(s.results, r)
+	return nil
+}
+
+func (s *jsonSink) Duplicates(groups []DuplicateGroup) error {
+	if s.ndjson {
+		if len(groups) == 0 {
+			return nil
+		}
+		return s.enc.Encode(struct {
+			Duplicates []DuplicateGroup `json:"duplicates"`
+		}{groups})
+	}
+
+	s.duplicates = groups
+	return nil
+}
+
+func (s *jsonSink) Summary(sum Summary) error {
+	if s.ndjson {
+		return s.enc.Encode(sum)
+	}
+
+	doc := struct {
+		Results    []Result         `json:"results"`
+		Duplicates []DuplicateGroup `json:"duplicates,omitempty"`
+		Summary    Summary          `json:"summary"`
+	}{s.results, s.duplicates, sum}
+	return s.enc.Encode(doc)
+}
+
+func (s *jsonSink) Close() error {
+	if printOnly {
+		return nil
+	}
+	return writeBrokenFile(s.brokenFile, s.broken)
+}
+
+// writeBrokenFile writes the accumulated broken uuids to path, newline
+// delimited, so -resume can pick them up on a later run. It is a no-op if
+// path is empty.
+func writeBrokenFile(path string, broken *brokenAccumulator) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(strings.Join(broken.items(), "\n"))
+	return err
+}
+
+// errorClass buckets an error message into a coarse class for the
+// summary's byErrorClass counts.
+func errorClass(msg string) string {
+	switch {
+	case msg == "":
+		return ""
+	case strings.Contains(msg, "unexpected type"):
+		return "unexpected-type"
+	case strings.Contains(msg, "not published by"):
+		return "not-published"
+	case strings.Contains(msg, "cycle reference detected"):
+		return "cycle"
+	case strings.HasPrefix(msg, "max depth"):
+		return "max-depth-exceeded"
+	case strings.HasPrefix(msg, "error "):
+		return "http-error"
+	default:
+		return "other"
+	}
+}
+
+// referencedUUIDs returns the uuids c directly references: ImageSet
+// members, or the image sets found in an Article's body.
+func referencedUUIDs(c *Content) []string {
+	if c == nil {
+		return nil
+	}
+
+	switch c.Type {
+	case "ImageSet":
+		var uuids []string
+		for _, m := range c.Members {
+			uuids = append(uuids, m.UUID)
+		}
+		return uuids
+	case "Article":
+		imgs, err := getImageSetFromBody(c)
+		if err != nil {
+			return nil
+		}
+		return dedupStrings(imgs)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// newResilientClient builds the shared http.Client used for all
+// document-store requests: it retries 5xx/429/network errors with
+// exponential backoff and jitter, and trips a circuit breaker once the
+// error rate within a window gets too high.
+func newResilientClient(maxRetries int, retryBase, retryMax time.Duration, cbThreshold float64, cbWindow time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{
+			next:       http.DefaultTransport,
+			maxRetries: maxRetries,
+			baseDelay:  retryBase,
+			maxDelay:   retryMax,
+			breaker:    newCircuitBreaker(cbThreshold, cbWindow),
+		},
+	}
+}
+
+// retryTransport wraps another RoundTripper with retries and circuit
+// breaking. A single flaky doc-store response no longer has to mark a
+// uuid broken outright.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	breaker    *circuitBreaker
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.Allow() {
+		return nil, fmt.Errorf("circuit breaker open: too many recent errors calling %s", req.URL)
+	}
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		resp, err = t.next.RoundTrip(req)
+		retryable := err != nil || isRetryableStatus(resp.StatusCode)
+		if !retryable {
+			break
+		}
+		if attempt >= t.maxRetries {
+			if err == nil {
+				err = fmt.Errorf("giving up after %d retries: status %d", t.maxRetries, resp.StatusCode)
+				resp.Body.Close()
+				resp = nil
+			}
+			break
+		}
+
+		wait := backoffDelay(t.baseDelay, t.maxDelay, attempt)
+		if resp != nil {
+			if ra, ok := retryAfter(resp); ok {
+				wait = ra
+			}
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	t.breaker.record(err != nil)
+	return resp, err
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoffDelay returns a "full jitter" exponential backoff: a random
+// duration between 0 and base*2^attempt, capped at max.
+func backoffDelay(base, max time.Duration, attempt int) time.Duration {
+	d := base * time.Duration(1<<uint(attempt))
+	if d <= 0 || d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryAfter parses a Retry-After response header, either as a number of
+// seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// circuitBreaker trips once the failure rate within the current window
+// reaches threshold, short-circuiting further requests until the window
+// rolls over. A nil circuitBreaker never trips.
+type circuitBreaker struct {
+	threshold float64
+	window    time.Duration
+
+	mu        sync.Mutex
+	windowEnd time.Time
+	requests  int
+	failures  int
+	openUntil time.Time
+}
+
+// minSampleSize avoids tripping the breaker on a handful of unlucky
+// requests before there's enough signal to call it a trend.
+const minSampleSize = 5
+
+func newCircuitBreaker(threshold float64, window time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window}
+}
+
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.After(b.windowEnd) {
+		b.requests, b.failures = 0, 0
+		b.windowEnd = now.Add(b.window)
+	}
+
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	if b.requests >= minSampleSize && float64(b.failures)/float64(b.requests) >= b.threshold {
+		b.openUntil = now.Add(b.window)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerNilNeverTrips(t *testing.T) {
+	var b *circuitBreaker
+	b.record(true)
+	if !b.Allow() {
+		t.Fatal("nil circuitBreaker should always Allow")
+	}
+}
+
+func TestCircuitBreakerStaysClosedBelowThreshold(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute)
+
+	for i := 0; i < minSampleSize; i++ {
+		b.record(i == 0) // 1 failure out of minSampleSize, well under 50%
+	}
+
+	if !b.Allow() {
+		t.Fatal("breaker tripped below its failure threshold")
+	}
+}
+
+func TestCircuitBreakerTripsAtThreshold(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute)
+
+	for i := 0; i < minSampleSize; i++ {
+		b.record(true)
+	}
+
+	if b.Allow() {
+		t.Fatal("breaker should have opened once failures reached the threshold")
+	}
+}
+
+func TestCircuitBreakerIgnoresSmallSamples(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute)
+
+	for i := 0; i < minSampleSize-1; i++ {
+		b.record(true)
+	}
+
+	if !b.Allow() {
+		t.Fatal("breaker tripped before reaching minSampleSize requests")
+	}
+}
+
+func TestCircuitBreakerClosesAfterWindowRollsOver(t *testing.T) {
+	b := newCircuitBreaker(0.5, 10*time.Millisecond)
+
+	for i := 0; i < minSampleSize; i++ {
+		b.record(true)
+	}
+	if b.Allow() {
+		t.Fatal("breaker should be open right after tripping")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("breaker should have closed once openUntil elapsed")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Traversal carries the state shared across every checkContent call made
+// while checking a run's whole uuid list: a visited set so a
+// diamond-shaped reference graph (the same ImageSet reachable from both an
+// article's mainImage and its body) is only fetched and walked once, even
+// when two workers or two branches reach it concurrently, and a -max-depth
+// cap so a long reference chain can't recurse until the stack blows.
+// Cycle detection itself is path-based, not part of this shared state -
+// see cyclePath.
+type Traversal struct {
+	maxDepth int
+
+	mu      sync.Mutex
+	visited map[string]*visitEntry
+}
+
+// visitEntry tracks one uuid's in-flight (or finished) check: done is
+// closed once the goroutine that claimed uuid calls record, unblocking
+// any other goroutine waiting on claim for the same uuid.
+type visitEntry struct {
+	done chan struct{}
+	err  error
+}
+
+func newTraversal(maxDepth int) *Traversal {
+	return &Traversal{maxDepth: maxDepth, visited: map[string]*visitEntry{}}
+}
+
+// claim reserves uuid for the calling goroutine to fetch and walk. The
+// first caller for a given uuid gets (nil, false) and must call record
+// once it's done; every other caller for the same uuid - whether it's a
+// different worker or a different branch of the same traversal - blocks
+// until that happens, then returns the same result with alreadyVisited
+// true. This is what makes the "only fetched once" guarantee hold under
+// concurrency, rather than just for branches that happen to run serially.
+func (t *Traversal) claim(ctx context.Context, uuid string) (err error, alreadyVisited bool) {
+	t.mu.Lock()
+	entry, exists := t.visited[uuid]
+	if !exists {
+		t.visited[uuid] = &visitEntry{done: make(chan struct{})}
+		t.mu.Unlock()
+		return nil, false
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-entry.done:
+		return entry.err, true
+	case <-ctx.Done():
+		return ctx.Err(), true
+	}
+}
+
+// record stores the outcome of checking uuid and releases any goroutine
+// blocked in claim for the same uuid.
+func (t *Traversal) record(uuid string, err error) {
+	t.mu.Lock()
+	entry := t.visited[uuid]
+	t.mu.Unlock()
+
+	entry.err = err
+	close(entry.done)
+}
+
+// cyclePath reports the full cycle (e.g. "A -> B -> C -> A") if uuid is
+// already on path, the current DFS stack of uuids being checked. path is
+// local to one traversal branch, so two unrelated branches that happen to
+// both reach the same uuid are not mistaken for a cycle.
+func cyclePath(path []string, uuid string) (string, bool) {
+	for i, p := range path {
+		if p == uuid {
+			return strings.Join(appendPath(path[i:], uuid), " -> "), true
+		}
+	}
+	return "", false
+}
+
+// checkDepth returns an error if following uuid would take path past
+// -max-depth.
+func checkDepth(path []string, uuid string, maxDepth int) error {
+	if len(path) < maxDepth {
+		return nil
+	}
+	return fmt.Errorf("max depth %d exceeded at %s", maxDepth, strings.Join(appendPath(path, uuid), " -> "))
+}
+
+// appendPath returns path+uuid as a freshly allocated slice. path is
+// shared across sibling branches of the same traversal, so it must never
+// be extended in place.
+func appendPath(path []string, uuid string) []string {
+	return append(append([]string{}, path...), uuid)
+}
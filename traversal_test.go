@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestCyclePath(t *testing.T) {
+	cases := []struct {
+		name string
+		path []string
+		uuid string
+		want string
+		ok   bool
+	}{
+		{"empty path", nil, "A", "", false},
+		{"no match", []string{"A", "B"}, "C", "", false},
+		{"direct self-reference", []string{"A"}, "A", "A -> A", true},
+		{"longer cycle", []string{"A", "B", "C"}, "B", "B -> C -> B", true},
+		{"match at start", []string{"A", "B", "C"}, "A", "A -> B -> C -> A", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := cyclePath(tc.path, tc.uuid)
+			if ok != tc.ok {
+				t.Fatalf("cyclePath(%v, %q) ok = %v, want %v", tc.path, tc.uuid, ok, tc.ok)
+			}
+			if ok && got != tc.want {
+				t.Fatalf("cyclePath(%v, %q) = %q, want %q", tc.path, tc.uuid, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCyclePathDoesNotMutateSharedPath(t *testing.T) {
+	path := make([]string, 1, 4)
+	path[0] = "A"
+
+	cyclePath(path, "B")
+	appendPath(path, "B")
+	appendPath(path, "C")
+
+	if len(path) != 1 || path[0] != "A" {
+		t.Fatalf("shared path was mutated: %v", path)
+	}
+}
+
+func TestTraversalClaimOneWinnerConcurrently(t *testing.T) {
+	tr := newTraversal(10)
+	const callers = 50
+
+	var wg sync.WaitGroup
+	var winners int32
+	var mu sync.Mutex
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, alreadyVisited := tr.claim(context.Background(), "uuid-1"); !alreadyVisited {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+				tr.record("uuid-1", errExpected)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Fatalf("expected exactly one caller to claim uuid-1, got %d", winners)
+	}
+}
+
+func TestTraversalClaimBlocksUntilRecord(t *testing.T) {
+	tr := newTraversal(10)
+
+	if _, alreadyVisited := tr.claim(context.Background(), "uuid-1"); alreadyVisited {
+		t.Fatal("first claim should not already be visited")
+	}
+
+	done := make(chan error)
+	go func() {
+		err, alreadyVisited := tr.claim(context.Background(), "uuid-1")
+		if !alreadyVisited {
+			t.Error("second claim should have blocked and then seen alreadyVisited = true")
+		}
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second claim returned before record was called")
+	default:
+	}
+
+	tr.record("uuid-1", errExpected)
+
+	if err := <-done; err != errExpected {
+		t.Fatalf("second claim got err = %v, want %v", err, errExpected)
+	}
+}
+
+var errExpected = &testError{"expected"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }